@@ -0,0 +1,65 @@
+// Package handler holds the small set of admin-only HTTP endpoints exposed
+// alongside the regular /sync3 API, for operators rather than clients.
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+const purgeRoomPathPrefix = "/_dendrite/admin/purgeRoom/"
+
+// PurgeRoomHandler implements POST /_dendrite/admin/purgeRoom/{roomID},
+// guarded by a shared secret, for operators to purge a problematic room from
+// the Dispatcher's own bookkeeping without restarting the proxy.
+//
+// The handler blocks until Dispatcher.OnPurgeRoom returns, which only
+// happens once every currently-registered receiver that implements
+// sync3.RoomPurgeReceiver has processed the purge. A 200 response does not
+// by itself mean every derived trace of the room (global cache, user
+// caches, live connections) is gone: that depends on those receivers
+// implementing RoomPurgeReceiver, which is opt-in.
+type PurgeRoomHandler struct {
+	Dispatcher   *sync3.Dispatcher
+	SharedSecret string
+}
+
+// RegisterRoutes mounts h on mux at its path prefix. Callers building the
+// admin HTTP server must call this (or register h against
+// purgeRoomPathPrefix themselves) for the endpoint to be reachable; the
+// handler does nothing on its own until it is mounted.
+func (h *PurgeRoomHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.Handle(purgeRoomPathPrefix, h)
+}
+
+func (h *PurgeRoomHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.isAuthorised(req) {
+		http.Error(w, "unauthorised", http.StatusUnauthorized)
+		return
+	}
+	roomID := strings.TrimPrefix(req.URL.Path, purgeRoomPathPrefix)
+	if roomID == "" || roomID == req.URL.Path {
+		http.Error(w, "missing room ID", http.StatusBadRequest)
+		return
+	}
+	h.Dispatcher.OnPurgeRoom(req.Context(), roomID)
+	w.WriteHeader(http.StatusOK)
+}
+
+// isAuthorised checks for "Authorization: Bearer <shared secret>", comparing
+// in constant time to avoid leaking the secret through response timing.
+func (h *PurgeRoomHandler) isAuthorised(req *http.Request) bool {
+	if h.SharedSecret == "" {
+		return false
+	}
+	want := "Bearer " + h.SharedSecret
+	got := req.Header.Get("Authorization")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
@@ -0,0 +1,178 @@
+package sync3
+
+import "sync"
+
+// sharedRoomsTracker tracks, for every user, the set of rooms they are
+// currently joined to, and for every room, its current member set. It
+// exists purely to answer "do these two users share at least one room"
+// cheaply, which is what drives device list tracking: per the E2EE spec, a
+// user only needs to know about another user's device list changes while
+// they share a room.
+//
+// Membership is stored per-user/per-room rather than as a materialised
+// pairwise count: computing whether a pair shares a room is a set
+// intersection over however many rooms each of them is actually in, which
+// in practice is far smaller than a room's member list, so seeding and
+// purging stay proportional to the memberships involved instead of to
+// their square.
+type sharedRoomsTracker struct {
+	mu        sync.Mutex
+	userRooms map[string]map[string]bool // user -> set of roomIDs they are joined to
+	roomUsers map[string]map[string]bool // roomID -> set of users joined to it
+}
+
+func newSharedRoomsTracker() *sharedRoomsTracker {
+	return &sharedRoomsTracker{
+		userRooms: make(map[string]map[string]bool),
+		roomUsers: make(map[string]map[string]bool),
+	}
+}
+
+// join records that user has just joined roomID, alongside others, a
+// snapshot of roomID's other current members, and returns the subset of
+// others whose shared-room count with user just became 1 (i.e. user and
+// other didn't already share some other room).
+func (s *sharedRoomsTracker) join(user, roomID string, others []string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var newlyShared []string
+	for _, other := range others {
+		if other != user && s.shareCount(user, other) == 0 {
+			newlyShared = append(newlyShared, other)
+		}
+	}
+	s.addMembership(user, roomID)
+	return newlyShared
+}
+
+// leave records that user has just left roomID, alongside others, a
+// snapshot of roomID's members as they stood immediately before user's
+// departure, and returns the subset of others whose shared-room count
+// with user just became 0.
+func (s *sharedRoomsTracker) leave(user, roomID string, others []string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeMembership(user, roomID)
+	var newlyUnshared []string
+	for _, other := range others {
+		if other != user && s.shareCount(user, other) == 0 {
+			newlyUnshared = append(newlyUnshared, other)
+		}
+	}
+	return newlyUnshared
+}
+
+// purgeRoom evicts roomID from every member's membership set in one pass
+// and reports which pairs had roomID as their only shared room, so the
+// caller can emit device-list "left" notifications for them. Unlike
+// join/leave this compares every pair of members against each other, so it
+// is only used by the rare, admin-triggered room purge path, not the
+// per-event join/leave hot path.
+func (s *sharedRoomsTracker) purgeRoom(roomID string, members []string) [][2]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var newlyUnshared [][2]string
+	for i, u := range members {
+		for _, v := range members[i+1:] {
+			if s.roomUsers[roomID][u] && s.roomUsers[roomID][v] && s.shareCount(u, v) == 1 {
+				newlyUnshared = append(newlyUnshared, [2]string{u, v})
+			}
+		}
+	}
+	for _, u := range members {
+		s.removeMembership(u, roomID)
+	}
+	return newlyUnshared
+}
+
+// coMembers returns every user who currently shares at least one room with
+// user, derived from the rooms user is joined to rather than a
+// precomputed pairwise list.
+func (s *sharedRoomsTracker) coMembers(user string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]bool)
+	for roomID := range s.userRooms[user] {
+		for other := range s.roomUsers[roomID] {
+			if other != user {
+				seen[other] = true
+			}
+		}
+	}
+	others := make([]string, 0, len(seen))
+	for other := range seen {
+		others = append(others, other)
+	}
+	return others
+}
+
+// shareCount must be called with s.mu held. It returns the number of rooms
+// a and b currently both belong to.
+func (s *sharedRoomsTracker) shareCount(a, b string) int {
+	count := 0
+	for roomID := range s.userRooms[a] {
+		if s.roomUsers[roomID][b] {
+			count++
+		}
+	}
+	return count
+}
+
+// addMembership must be called with s.mu held. It records that user is
+// joined to roomID.
+func (s *sharedRoomsTracker) addMembership(user, roomID string) {
+	rooms, ok := s.userRooms[user]
+	if !ok {
+		rooms = make(map[string]bool)
+		s.userRooms[user] = rooms
+	}
+	rooms[roomID] = true
+
+	users, ok := s.roomUsers[roomID]
+	if !ok {
+		users = make(map[string]bool)
+		s.roomUsers[roomID] = users
+	}
+	users[user] = true
+}
+
+// removeMembership must be called with s.mu held. It records that user is
+// no longer joined to roomID.
+func (s *sharedRoomsTracker) removeMembership(user, roomID string) {
+	if rooms, ok := s.userRooms[user]; ok {
+		delete(rooms, roomID)
+		if len(rooms) == 0 {
+			delete(s.userRooms, user)
+		}
+	}
+	if users, ok := s.roomUsers[roomID]; ok {
+		delete(users, user)
+		if len(users) == 0 {
+			delete(s.roomUsers, roomID)
+		}
+	}
+}
+
+// seed bulk-loads room membership from a room->members snapshot, without
+// emitting any transitions (there are no live connections to notify yet;
+// this is only ever called from Dispatcher.Startup). Cost is linear in the
+// total number of memberships handed to us: it records each user's own
+// room set directly, rather than comparing every pair of members in every
+// room.
+func (s *sharedRoomsTracker) seed(roomToJoinedUsers map[string][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for roomID, members := range roomToJoinedUsers {
+		users := make(map[string]bool, len(members))
+		for _, u := range members {
+			users[u] = true
+			rooms, ok := s.userRooms[u]
+			if !ok {
+				rooms = make(map[string]bool)
+				s.userRooms[u] = rooms
+			}
+			rooms[roomID] = true
+		}
+		s.roomUsers[roomID] = users
+	}
+}
@@ -0,0 +1,113 @@
+package sync3
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSharedRoomsTrackerJoinLeave(t *testing.T) {
+	s := newSharedRoomsTracker()
+
+	// alice joins room1 with no one else present yet: nothing to report.
+	if got := s.join("alice", "room1", nil); len(got) != 0 {
+		t.Fatalf("alice join alone: got newly shared %v, want none", got)
+	}
+
+	// bob joins room1 alongside alice: they share a room for the first time.
+	if got := s.join("bob", "room1", []string{"alice"}); !sameStringSet(got, []string{"alice"}) {
+		t.Fatalf("bob join room1: got newly shared %v, want [alice]", got)
+	}
+
+	// alice and bob also end up in room2 together, but they already share
+	// room1, so this must not be reported as newly shared again.
+	s.join("alice", "room2", nil)
+	if got := s.join("bob", "room2", []string{"alice"}); len(got) != 0 {
+		t.Fatalf("bob join room2 while already sharing room1: got %v, want none", got)
+	}
+
+	// bob leaves room1: he and alice still share room2, so nobody is
+	// reported as newly unshared.
+	if got := s.leave("bob", "room1", []string{"alice"}); len(got) != 0 {
+		t.Fatalf("bob leave room1 while still sharing room2: got %v, want none", got)
+	}
+
+	// bob leaves room2 too: now they share nothing.
+	if got := s.leave("bob", "room2", []string{"alice"}); !sameStringSet(got, []string{"alice"}) {
+		t.Fatalf("bob leave room2: got newly unshared %v, want [alice]", got)
+	}
+
+	if got := s.coMembers("bob"); len(got) != 0 {
+		t.Fatalf("coMembers(bob) after leaving everything: got %v, want none", got)
+	}
+}
+
+func TestSharedRoomsTrackerPurgeRoom(t *testing.T) {
+	s := newSharedRoomsTracker()
+	s.seed(map[string][]string{
+		"room1": {"alice", "bob", "carol"},
+		"room2": {"alice", "bob"},
+	})
+
+	pairs := s.purgeRoom("room1", []string{"alice", "bob", "carol"})
+
+	// alice/bob still share room2 after room1 is purged, so that pair must
+	// not show up. alice/carol and bob/carol only ever shared room1, so
+	// both pairs must be reported as newly unshared.
+	want := map[[2]string]bool{
+		{"alice", "carol"}: true,
+		{"bob", "carol"}:   true,
+	}
+	if len(pairs) != len(want) {
+		t.Fatalf("purgeRoom: got %d pairs %v, want %d", len(pairs), pairs, len(want))
+	}
+	for _, p := range pairs {
+		if !want[p] && !want[[2]string{p[1], p[0]}] {
+			t.Fatalf("purgeRoom: unexpected pair %v", p)
+		}
+	}
+
+	// room1's membership must be fully forgotten: purging it again is a no-op.
+	if again := s.purgeRoom("room1", []string{"alice", "bob", "carol"}); len(again) != 0 {
+		t.Fatalf("purgeRoom a second time: got %v, want none", again)
+	}
+}
+
+// TestSharedRoomsTrackerConcurrentJoinLeave exercises join/leave/coMembers
+// from many goroutines at once; run with -race, its purpose is to catch
+// data races in the maps rather than to assert any particular outcome.
+func TestSharedRoomsTrackerConcurrentJoinLeave(t *testing.T) {
+	s := newSharedRoomsTracker()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := fmt.Sprintf("user%d", i)
+			s.join(user, "room1", nil)
+			s.coMembers(user)
+			s.leave(user, "room1", nil)
+		}(i)
+	}
+	wg.Wait()
+
+	if got := s.coMembers("user0"); len(got) != 0 {
+		t.Fatalf("coMembers after everyone left: got %v, want none", got)
+	}
+}
+
+func sameStringSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]bool, len(b))
+	for _, v := range b {
+		seen[v] = true
+	}
+	for _, v := range a {
+		if !seen[v] {
+			return false
+		}
+	}
+	return true
+}
@@ -5,10 +5,13 @@ import (
 	"encoding/json"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/matrix-org/sliding-sync/sync3/pushrules"
 	"github.com/rs/zerolog"
+	"github.com/tidwall/gjson"
 )
 
 var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
@@ -27,18 +30,264 @@ type Receiver interface {
 	OnRegistered(ctx context.Context) error
 }
 
+// RoomPurgeReceiver is an optional extra a Receiver may implement to hear
+// about admin-triggered room purges. It is not part of the core Receiver
+// interface because most receivers only care about it incidentally: the
+// global cache and user caches need to drop their own state for roomID,
+// while a live connection additionally needs to emit a synthetic DELETE op
+// for roomID if it is currently in its sliding window, so the client drops
+// it immediately instead of waiting for a reload.
+type RoomPurgeReceiver interface {
+	OnPurgeRoom(ctx context.Context, roomID string)
+}
+
+// Pusher is implemented by anything that wants to be told about events which
+// match a user's push rules, so it can forward them on to a push gateway.
+// Unlike Receiver, a Pusher is never required: a user with no pushers
+// registered simply has their push rules evaluated for nothing.
+type Pusher interface {
+	// OnPushableEvent is called after push rule evaluation determines that
+	// event should be notified/highlighted/sounded for userID. roomCtx
+	// provides the extra room context (name, member count, power levels)
+	// needed to build an intelligible payload for the gateway.
+	OnPushableEvent(ctx context.Context, userID string, action pushrules.Action, event *caches.EventData, roomCtx PushRoomContext)
+}
+
+// PushRoomContext carries the room metadata the Dispatcher gathered (from
+// the event and its RoomStateLoader) while evaluating push rules for an
+// event, handed to each Pusher to format a push payload. JoinedMemberCount,
+// PowerLevelOfSender and NotificationPowerLevels are the values the rule
+// conditions were evaluated against; the rest is only for payload formatting.
+type PushRoomContext struct {
+	RoomName                string
+	JoinedMemberCount       int
+	DisplayNameOfSender     string
+	PowerLevelOfSender      int
+	NotificationPowerLevels map[string]int
+}
+
+// PushRulesLoader is implemented by whatever owns account data storage, so
+// the Dispatcher can fetch a user's current push rules without needing to
+// know how they are persisted.
+type PushRulesLoader interface {
+	PushRulesForUser(ctx context.Context, userID string) (*pushrules.Ruleset, error)
+}
+
+// RoomStateLoader is implemented by whatever tracks room state (typically
+// *caches.GlobalCache), so the Dispatcher can fetch the extra per-room,
+// per-member context push rule evaluation and payload formatting need
+// beyond what an EventData retains: member display names and power levels.
+type RoomStateLoader interface {
+	// RoomName returns roomID's current calculated name, for payload formatting.
+	RoomName(roomID string) string
+	// DisplayName returns userID's display name in roomID, or "" if they
+	// have none set.
+	DisplayName(roomID, userID string) string
+	// PowerLevel returns userID's power level in roomID, per the room's
+	// m.room.power_levels state (or 0 if there is none).
+	PowerLevel(roomID, userID string) int
+	// NotificationPowerLevels returns roomID's m.room.power_levels
+	// "notifications" object (e.g. {"room": 50}).
+	NotificationPowerLevels(roomID string) map[string]int
+}
+
+// DeviceListReceiver is an optional extra a Receiver may implement (typically
+// *caches.UserCache) to accumulate device list deltas for the /sync
+// response's device_lists field. changed/left are userIDs, not devices: the
+// Matrix spec tracks device list staleness at the user granularity and
+// leaves it to /keys/query to fetch the actual devices.
+type DeviceListReceiver interface {
+	OnDeviceListChange(ctx context.Context, forUser string, changed, left []string)
+}
+
+// TypingReceiver is an optional extra a Receiver may implement to hear about
+// m.typing changes for a room. It is only invoked when the visible typing
+// set actually changes, so implementations don't need to de-duplicate
+// identical retransmits themselves.
+type TypingReceiver interface {
+	OnTypingChange(ctx context.Context, roomID string, userIDs []string)
+}
+
 // Dispatches live events to caches
 type Dispatcher struct {
 	jrt              *JoinedRoomsTracker
 	userToReceiver   map[string]Receiver
+	userToQueue      map[string]*receiverEntry
 	userToReceiverMu *sync.RWMutex
+
+	pushRulesLoader PushRulesLoader
+	roomStateLoader RoomStateLoader
+	pushEvaluator   pushrules.Evaluator
+
+	userToPushers   map[string][]Pusher
+	pushersMu       *sync.RWMutex
+
+	pushRuleCache   map[string]*pushrules.Ruleset
+	pushRuleCacheMu *sync.Mutex
+
+	sharedRooms *sharedRoomsTracker
+	typingCache *TypingCache
+
+	receiverQueueDepth int
 }
 
 func NewDispatcher() *Dispatcher {
-	return &Dispatcher{
-		jrt:              NewJoinedRoomsTracker(),
-		userToReceiver:   make(map[string]Receiver),
-		userToReceiverMu: &sync.RWMutex{},
+	d := &Dispatcher{
+		jrt:                NewJoinedRoomsTracker(),
+		userToReceiver:     make(map[string]Receiver),
+		userToQueue:        make(map[string]*receiverEntry),
+		userToReceiverMu:   &sync.RWMutex{},
+		userToPushers:      make(map[string][]Pusher),
+		pushersMu:          &sync.RWMutex{},
+		pushRuleCache:      make(map[string]*pushrules.Ruleset),
+		pushRuleCacheMu:    &sync.Mutex{},
+		sharedRooms:        newSharedRoomsTracker(),
+		receiverQueueDepth: defaultReceiverQueueDepth,
+	}
+	d.typingCache = NewTypingCache(d.onTypingExpire)
+	return d
+}
+
+// SetReceiverQueueDepth overrides how many pending dispatches are buffered
+// per receiver (see enqueueRoomEvent/enqueueBlockWithTimeout/
+// enqueueDropOldest for what happens once that fills up) before the next
+// Register call picks it up; receivers already registered keep whatever
+// depth they were created with.
+func (d *Dispatcher) SetReceiverQueueDepth(depth int) {
+	d.receiverQueueDepth = depth
+}
+
+// SetPushRulesLoader configures where the Dispatcher fetches a user's push
+// rules from. Must be called before any events are dispatched if push rule
+// evaluation is desired.
+func (d *Dispatcher) SetPushRulesLoader(l PushRulesLoader) {
+	d.pushRulesLoader = l
+}
+
+// SetRoomStateLoader configures where the Dispatcher fetches member display
+// names and power levels from for push rule evaluation. Must be called
+// before any events are dispatched if contains_display_name or
+// sender_notification_permission conditions, or payload formatting that
+// needs the room name or sender's display name, are to work; without it
+// those conditions never match and that formatting is left blank.
+func (d *Dispatcher) SetRoomStateLoader(l RoomStateLoader) {
+	d.roomStateLoader = l
+}
+
+// RegisterPusher adds p to the set of gateways notified when userID's push
+// rules match an event. A user may have multiple pushers (one per device).
+func (d *Dispatcher) RegisterPusher(userID string, p Pusher) {
+	d.pushersMu.Lock()
+	defer d.pushersMu.Unlock()
+	d.userToPushers[userID] = append(d.userToPushers[userID], p)
+}
+
+// UnregisterPusher removes p from userID's pusher set.
+func (d *Dispatcher) UnregisterPusher(userID string, p Pusher) {
+	d.pushersMu.Lock()
+	defer d.pushersMu.Unlock()
+	pushers := d.userToPushers[userID]
+	for i, existing := range pushers {
+		if existing == p {
+			d.userToPushers[userID] = append(pushers[:i], pushers[i+1:]...)
+			break
+		}
+	}
+	if len(d.userToPushers[userID]) == 0 {
+		delete(d.userToPushers, userID)
+	}
+}
+
+// OnAccountData is called by v2 pollers when account data changes for a user.
+// We only care about m.push_rules, which invalidates our compiled rule cache
+// for that user so the next event picks up the new rules.
+func (d *Dispatcher) OnAccountData(ctx context.Context, userID string, events []json.RawMessage) {
+	for _, e := range events {
+		evType := gjson.GetBytes(e, "type").Str
+		if evType == "m.push_rules" {
+			d.pushRuleCacheMu.Lock()
+			delete(d.pushRuleCache, userID)
+			d.pushRuleCacheMu.Unlock()
+			break
+		}
+	}
+}
+
+// pushRulesForUser returns userID's compiled push rules, using the cache if
+// possible and falling back to the configured PushRulesLoader otherwise.
+func (d *Dispatcher) pushRulesForUser(ctx context.Context, userID string) *pushrules.Ruleset {
+	if d.pushRulesLoader == nil {
+		return nil
+	}
+	d.pushRuleCacheMu.Lock()
+	rs, ok := d.pushRuleCache[userID]
+	d.pushRuleCacheMu.Unlock()
+	if ok {
+		return rs
+	}
+	rs, err := d.pushRulesLoader.PushRulesForUser(ctx, userID)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Msg("Dispatcher: failed to load push rules")
+		return nil
+	}
+	d.pushRuleCacheMu.Lock()
+	d.pushRuleCache[userID] = rs
+	d.pushRuleCacheMu.Unlock()
+	return rs
+}
+
+// evaluatePushRules evaluates userID's push rules against ed and, if they
+// produce a notify action, forwards ed to every pusher userID has
+// registered. It is always called from userID's own receiver delivery
+// goroutine (see notifyListeners), never inline from the v2 poller: loading
+// push rules and room state can involve a DB round trip, and running that
+// synchronously in the dispatch hot path would let one user's slow lookup
+// delay every other user's events.
+func (d *Dispatcher) evaluatePushRules(ctx context.Context, userID string, ed *caches.EventData) {
+	d.pushersMu.RLock()
+	pushers := d.userToPushers[userID]
+	d.pushersMu.RUnlock()
+	if len(pushers) == 0 {
+		return
+	}
+	rs := d.pushRulesForUser(ctx, userID)
+	if rs == nil {
+		return
+	}
+
+	var roomName, displayName, senderDisplayName string
+	var powerLevelOfSender int
+	var notificationPowerLevels map[string]int
+	if d.roomStateLoader != nil {
+		roomName = d.roomStateLoader.RoomName(ed.RoomID)
+		displayName = d.roomStateLoader.DisplayName(ed.RoomID, userID)
+		senderDisplayName = d.roomStateLoader.DisplayName(ed.RoomID, ed.Sender)
+		powerLevelOfSender = d.roomStateLoader.PowerLevel(ed.RoomID, ed.Sender)
+		notificationPowerLevels = d.roomStateLoader.NotificationPowerLevels(ed.RoomID)
+	}
+
+	action, _ := d.pushEvaluator.Evaluate(ed.Content, rs, pushrules.EventContext{
+		RoomID:                  ed.RoomID,
+		EventType:               ed.EventType,
+		Sender:                  ed.Sender,
+		UserID:                  userID,
+		DisplayName:             displayName,
+		JoinedMemberCount:       ed.JoinCount,
+		PowerLevelOfSender:      powerLevelOfSender,
+		NotificationPowerLevels: notificationPowerLevels,
+	})
+	if !action.Notify {
+		return
+	}
+	roomCtx := PushRoomContext{
+		RoomName:                roomName,
+		JoinedMemberCount:       ed.JoinCount,
+		DisplayNameOfSender:     senderDisplayName,
+		PowerLevelOfSender:      powerLevelOfSender,
+		NotificationPowerLevels: notificationPowerLevels,
+	}
+	for _, p := range pushers {
+		p.OnPushableEvent(ctx, userID, action, ed, roomCtx)
 	}
 }
 
@@ -46,28 +295,97 @@ func (d *Dispatcher) IsUserJoined(userID, roomID string) bool {
 	return d.jrt.IsUserJoined(userID, roomID)
 }
 
+// CurrentlyTyping returns roomID's current typing set, for a connection
+// that's performing an initial sync to seed its payload with, rather than
+// waiting for the next m.typing delta.
+func (d *Dispatcher) CurrentlyTyping(roomID string) []string {
+	return d.typingCache.CurrentlyTyping(roomID)
+}
+
 // Load joined members into the dispatcher.
 // MUST BE CALLED BEFORE V2 POLL LOOPS START.
 func (d *Dispatcher) Startup(roomToJoinedUsers map[string][]string) error {
 	// populate joined rooms tracker
 	d.jrt.Startup(roomToJoinedUsers)
+	// populate shared-room counts for device list tracking, quietly: there
+	// are no connections registered yet, so there is nothing to notify.
+	d.sharedRooms.seed(roomToJoinedUsers)
 	return nil
 }
 
 func (d *Dispatcher) Unregister(userID string) {
 	d.userToReceiverMu.Lock()
 	defer d.userToReceiverMu.Unlock()
+	if entry, ok := d.userToQueue[userID]; ok {
+		close(entry.stop)
+		delete(d.userToQueue, userID)
+	}
 	delete(d.userToReceiver, userID)
+	deleteReceiverMetrics(userID)
 }
 
+// registerTimeout bounds how long we'll wait for a newly registered
+// receiver's OnRegistered to complete. A receiver that never finishes
+// registering (e.g. stuck loading initial state) must not be left behind as
+// a dead entry that every future dispatch tries, and fails, to deliver to.
+const registerTimeout = 5 * time.Second
+
+// Register only makes r reachable for dispatch once r.OnRegistered has
+// returned successfully, and only holds userToReceiverMu for the brief map
+// updates either side of that call, not for the call itself: OnRegistered
+// can do real work (e.g. loading initial state), and every other user's
+// dispatch takes the same lock, so holding it for the whole call would stall
+// the rest of the dispatcher for up to registerTimeout. If userID already
+// has a registered receiver, its entry keeps serving dispatches until r's
+// registration succeeds, so a failed or timed-out re-registration leaves the
+// previous receiver exactly as it was. Register re-checks, once OnRegistered
+// returns, that userID's entry is still the one it started with; if an
+// Unregister (or another Register) ran in the meantime, it backs off instead
+// of resurrecting a receiver someone else just tore down.
 func (d *Dispatcher) Register(ctx context.Context, userID string, r Receiver) error {
 	d.userToReceiverMu.Lock()
-	defer d.userToReceiverMu.Unlock()
-	if _, ok := d.userToReceiver[userID]; ok {
-		logger.Warn().Str("user", userID).Msg("Dispatcher.Register: receiver already registered")
+	oldEntry := d.userToQueue[userID]
+	entry := newReceiverEntry(userID, r, d.receiverQueueDepth)
+	d.userToReceiverMu.Unlock()
+
+	go d.run(entry)
+
+	registered := make(chan error, 1)
+	go func() {
+		registered <- r.OnRegistered(ctx)
+	}()
+	select {
+	case err := <-registered:
+		if err != nil {
+			close(entry.stop)
+			return err
+		}
+	case <-time.After(registerTimeout):
+		logger.Warn().Str("user", userID).Msg("Dispatcher.Register: OnRegistered did not complete within deadline, dropping receiver")
+		close(entry.stop)
+		return context.Canceled
+	}
+
+	d.userToReceiverMu.Lock()
+	if d.userToQueue[userID] != oldEntry {
+		// userID's registration state moved on while we were waiting on
+		// OnRegistered (an Unregister or a competing Register won the
+		// race); don't overwrite whatever is there now.
+		d.userToReceiverMu.Unlock()
+		close(entry.stop)
+		return context.Canceled
+	}
+	if oldEntry != nil {
+		logger.Warn().Str("user", userID).Msg("Dispatcher.Register: receiver already registered, replacing")
 	}
 	d.userToReceiver[userID] = r
-	return r.OnRegistered(ctx)
+	d.userToQueue[userID] = entry
+	d.userToReceiverMu.Unlock()
+
+	if oldEntry != nil {
+		close(oldEntry.stop)
+	}
+	return nil
 }
 
 func (d *Dispatcher) ReceiverForUser(userID string) Receiver {
@@ -143,12 +461,19 @@ func (d *Dispatcher) OnNewEvent(
 			// we only do this to track invite counts correctly.
 			d.jrt.UsersInvitedToRoom([]string{targetUser}, ed.RoomID)
 		case "join":
+			wasAlreadyJoined := d.jrt.IsUserJoined(targetUser, ed.RoomID)
 			if d.jrt.UserJoinedRoom(targetUser, ed.RoomID) {
 				shouldForceInitial = true
 			}
+			if !wasAlreadyJoined {
+				d.onUserJoinedRoom(ctx, targetUser, ed.RoomID)
+			}
 		case "ban":
 			fallthrough
 		case "leave":
+			if d.jrt.IsUserJoined(targetUser, ed.RoomID) {
+				d.onUserLeftRoom(ctx, targetUser, ed.RoomID)
+			}
 			d.jrt.UserLeftRoom(targetUser, ed.RoomID)
 		}
 		ed.InviteCount = d.jrt.NumInvitedUsersForRoom(ed.RoomID)
@@ -165,7 +490,75 @@ func (d *Dispatcher) OnNewEvent(
 	d.notifyListeners(ctx, ed, userIDs, targetUser, shouldForceInitial, membership)
 }
 
+// OnEphemeralEvent routes ephemeral events by type: m.typing goes through the
+// TypingCache so its change-suppression and late-joiner semantics apply,
+// everything else is passed through to receivers unchanged, as before.
 func (d *Dispatcher) OnEphemeralEvent(ctx context.Context, roomID string, ephEvent json.RawMessage) {
+	if gjson.GetBytes(ephEvent, "type").Str == "m.typing" {
+		userIDs := make([]string, 0)
+		for _, v := range gjson.GetBytes(ephEvent, "content.user_ids").Array() {
+			userIDs = append(userIDs, v.Str)
+		}
+		d.onTypingUpdate(ctx, roomID, userIDs)
+		return
+	}
+	d.fanoutEphemeralEvent(ctx, roomID, ephEvent)
+}
+
+// onTypingUpdate updates the TypingCache for roomID and, if the visible set
+// changed, notifies every joined receiver that implements TypingReceiver.
+func (d *Dispatcher) onTypingUpdate(ctx context.Context, roomID string, userIDs []string) {
+	changed, current := d.typingCache.Update(roomID, userIDs)
+	if !changed {
+		return
+	}
+	d.dispatchTypingChange(ctx, roomID, current)
+}
+
+// onTypingExpire is the TypingCache's onExpire callback: it fires from a
+// timer goroutine with no request in flight, so there is no meaningful
+// context to propagate and we fall back to context.Background().
+func (d *Dispatcher) onTypingExpire(roomID, userID string) {
+	d.dispatchTypingChange(context.Background(), roomID, d.typingCache.CurrentlyTyping(roomID))
+}
+
+// dispatchTypingChange queues roomID's current typing set for the global
+// listener and every joined receiver that implements TypingReceiver, via
+// each receiver's own delivery goroutine rather than calling it directly.
+func (d *Dispatcher) dispatchTypingChange(ctx context.Context, roomID string, current []string) {
+	notifyUserIDs, _ := d.jrt.JoinedUsersForRoom(roomID, func(userID string) bool {
+		if userID == DispatcherAllUsers {
+			return false // safety guard to prevent dupe global callbacks
+		}
+		return d.ReceiverForUser(userID) != nil
+	})
+
+	d.userToReceiverMu.RLock()
+	defer d.userToReceiverMu.RUnlock()
+
+	if entry := d.userToQueue[DispatcherAllUsers]; entry != nil {
+		if tr, ok := d.userToReceiver[DispatcherAllUsers].(TypingReceiver); ok {
+			d.enqueueDropOldest(entry, queuedDispatch{kind: dispatchCallback, ctx: ctx, fn: func() {
+				tr.OnTypingChange(ctx, roomID, current)
+			}})
+		}
+	}
+	for _, userID := range notifyUserIDs {
+		entry := d.userToQueue[userID]
+		if entry == nil {
+			continue
+		}
+		tr, ok := d.userToReceiver[userID].(TypingReceiver)
+		if !ok {
+			continue
+		}
+		d.enqueueDropOldest(entry, queuedDispatch{kind: dispatchCallback, ctx: ctx, fn: func() {
+			tr.OnTypingChange(ctx, roomID, current)
+		}})
+	}
+}
+
+func (d *Dispatcher) fanoutEphemeralEvent(ctx context.Context, roomID string, ephEvent json.RawMessage) {
 	notifyUserIDs, _ := d.jrt.JoinedUsersForRoom(roomID, func(userID string) bool {
 		if userID == DispatcherAllUsers {
 			return false // safety guard to prevent dupe global callbacks
@@ -177,18 +570,17 @@ func (d *Dispatcher) OnEphemeralEvent(ctx context.Context, roomID string, ephEve
 	defer d.userToReceiverMu.RUnlock()
 
 	// global listeners (invoke before per-user listeners so caches can update)
-	listener := d.userToReceiver[DispatcherAllUsers]
-	if listener != nil {
-		listener.OnEphemeralEvent(ctx, roomID, ephEvent)
+	if entry := d.userToQueue[DispatcherAllUsers]; entry != nil {
+		d.enqueueDropOldest(entry, queuedDispatch{kind: dispatchEphemeralEvent, ctx: ctx, roomID: roomID, ephEvent: ephEvent})
 	}
 
 	// poke user caches OnEphemeralEvent which then pokes ConnState
 	for _, userID := range notifyUserIDs {
-		l := d.userToReceiver[userID]
-		if l == nil {
+		entry := d.userToQueue[userID]
+		if entry == nil {
 			continue
 		}
-		l.OnEphemeralEvent(ctx, roomID, ephEvent)
+		d.enqueueDropOldest(entry, queuedDispatch{kind: dispatchEphemeralEvent, ctx: ctx, roomID: roomID, ephEvent: ephEvent})
 	}
 }
 
@@ -204,62 +596,237 @@ func (d *Dispatcher) OnReceipt(ctx context.Context, receipt internal.Receipt) {
 	defer d.userToReceiverMu.RUnlock()
 
 	// global listeners (invoke before per-user listeners so caches can update)
-	listener := d.userToReceiver[DispatcherAllUsers]
-	if listener != nil {
-		listener.OnReceipt(ctx, receipt) // FIXME: redundant, it doesn't care about receipts
+	if entry := d.userToQueue[DispatcherAllUsers]; entry != nil {
+		d.enqueueDropOldest(entry, queuedDispatch{kind: dispatchReceipt, ctx: ctx, receipt: receipt}) // FIXME: redundant, it doesn't care about receipts
 	}
 
 	// poke user caches OnReceipt which then pokes ConnState
 	for _, userID := range notifyUserIDs {
-		l := d.userToReceiver[userID]
-		if l == nil {
+		entry := d.userToQueue[userID]
+		if entry == nil {
 			continue
 		}
-		l.OnReceipt(ctx, receipt)
+		d.enqueueDropOldest(entry, queuedDispatch{kind: dispatchReceipt, ctx: ctx, receipt: receipt})
+	}
+}
+
+// onUserJoinedRoom updates shared-room counts for target joining roomID, and
+// tells target and every existing co-member about each other's device list
+// the moment they start sharing a room. Must be called after the tracker has
+// recorded target's join, so JoinedUsersForRoom includes them alongside the
+// co-members we want to pair them against.
+func (d *Dispatcher) onUserJoinedRoom(ctx context.Context, target, roomID string) {
+	others, _ := d.jrt.JoinedUsersForRoom(roomID, func(userID string) bool {
+		return userID != DispatcherAllUsers
+	})
+	d.shareRoomWithOthers(ctx, target, roomID, others)
+}
+
+// onUserLeftRoom is the mirror of onUserJoinedRoom: it must be called while
+// target is still present in JoinedUsersForRoom(roomID), before the caller
+// removes them from the JoinedRoomsTracker.
+func (d *Dispatcher) onUserLeftRoom(ctx context.Context, target, roomID string) {
+	others, _ := d.jrt.JoinedUsersForRoom(roomID, func(userID string) bool {
+		return userID != DispatcherAllUsers
+	})
+	d.unshareRoomWithOthers(ctx, target, roomID, others)
+}
+
+// shareRoomWithOthers records that target just joined roomID alongside
+// others, emitting device-list "changed" notifications for any pair that
+// just started sharing a room.
+func (d *Dispatcher) shareRoomWithOthers(ctx context.Context, target, roomID string, others []string) {
+	for _, other := range d.sharedRooms.join(target, roomID, others) {
+		d.notifyDeviceListChange(ctx, other, []string{target}, nil)
+		d.notifyDeviceListChange(ctx, target, []string{other}, nil)
+	}
+}
+
+// unshareRoomWithOthers is the mirror of shareRoomWithOthers: it records
+// that target just left roomID, emitting device-list "left" notifications
+// for any pair that no longer shares a room. others must be the room's
+// membership as it stood before target's departure was applied to the
+// JoinedRoomsTracker.
+func (d *Dispatcher) unshareRoomWithOthers(ctx context.Context, target, roomID string, others []string) {
+	for _, other := range d.sharedRooms.leave(target, roomID, others) {
+		d.notifyDeviceListChange(ctx, other, nil, []string{target})
+		d.notifyDeviceListChange(ctx, target, nil, []string{other})
 	}
 }
 
+// OnDeviceListUpdate is called when userID's own device list rotates (e.g.
+// a new device is added, or an existing one's keys change). Every user who
+// currently shares a room with userID needs to know their device list is
+// stale; userID themselves does not need telling about their own change.
+func (d *Dispatcher) OnDeviceListUpdate(ctx context.Context, userID string) {
+	for _, other := range d.sharedRooms.coMembers(userID) {
+		d.notifyDeviceListChange(ctx, other, []string{userID}, nil)
+	}
+}
+
+// notifyDeviceListChange queues a device list delta for forUser's receiver,
+// via its own delivery goroutine, if it is registered and opts into
+// DeviceListReceiver. The receiver/queue lookup is the only part done under
+// userToReceiverMu: the actual enqueue can block for up to
+// roomEventSendTimeout waiting on a full queue, and holding the lock across
+// that would stall every concurrent Register/Unregister for as long as one
+// slow receiver's queue stays full.
+func (d *Dispatcher) notifyDeviceListChange(ctx context.Context, forUser string, changed, left []string) {
+	d.userToReceiverMu.RLock()
+	r := d.userToReceiver[forUser]
+	entry := d.userToQueue[forUser]
+	d.userToReceiverMu.RUnlock()
+
+	if r == nil || entry == nil {
+		return
+	}
+	dlr, ok := r.(DeviceListReceiver)
+	if !ok {
+		return
+	}
+	// Unlike ephemeral events and receipts, each call here carries a unique
+	// delta rather than the latest full state, so dropping one permanently
+	// loses it instead of being superseded by the next update. Use the
+	// block-with-timeout policy so a full queue delays delivery instead of
+	// silently discarding it.
+	d.enqueueBlockWithTimeout(entry, queuedDispatch{kind: dispatchCallback, ctx: ctx, fn: func() {
+		dlr.OnDeviceListChange(ctx, forUser, changed, left)
+	}})
+}
+
+// notifyListeners hands ed off to every receiver's own delivery goroutine
+// rather than calling receivers directly, so a single slow receiver can
+// only ever back up its own queue, never block this v2 poller. ctx is
+// retained for the lifetime of the queued dispatch, which may outlive the
+// original caller now that delivery is asynchronous.
+//
+// All receiver/queue lookups happen in one pass under userToReceiverMu,
+// which is released before any enqueue is attempted: the global listener's
+// enqueue uses the block-with-timeout policy and can take up to
+// roomEventSendTimeout, and holding the lock across that would stall every
+// concurrent Register/Unregister for as long as the global listener's queue
+// stays full.
 func (d *Dispatcher) notifyListeners(ctx context.Context, ed *caches.EventData, userIDs []string, targetUser string, shouldForceInitial bool, membership string) {
 	internal.Logf(ctx, "dispatcher", "%s: notify %d users (nid=%d,join_count=%d)", ed.RoomID, len(userIDs), ed.NID, ed.JoinCount)
-	// invoke listeners
-	d.userToReceiverMu.RLock()
-	defer d.userToReceiverMu.RUnlock()
 
-	// global listeners (invoke before per-user listeners so caches can update)
-	listener := d.userToReceiver[DispatcherAllUsers]
-	if listener != nil {
-		listener.OnNewEvent(ctx, ed)
+	type perUserDispatch struct {
+		userID string
+		entry  *receiverEntry
+		ed     *caches.EventData
 	}
 
-	// per-user listeners
+	d.userToReceiverMu.RLock()
+	globalEntry := d.userToQueue[DispatcherAllUsers]
 	notifiedTarget := false
+	dispatches := make([]perUserDispatch, 0, len(userIDs))
 	for _, userID := range userIDs {
-		l := d.userToReceiver[userID]
-		if l != nil {
-			edd := *ed
-			if targetUser == userID {
-				notifiedTarget = true
-				if shouldForceInitial {
-					edd.ForceInitial = true
-				}
-			}
-			l.OnNewEvent(ctx, &edd)
+		entry := d.userToQueue[userID]
+		if entry == nil {
+			continue
 		}
-	}
-	if targetUser != "" && !notifiedTarget { // e.g invites/leaves where you aren't joined yet but need to know about it
-		// We expect invites to come down the invitee's poller, which triggers OnInvite code paths and
-		// not normal event codepaths. We need the separate code path to ensure invite stripped state
-		// is sent to the conn and not live data. Hence, if we get the invite event early from a different
-		// connection, do not send it to the target, as they must wait for the invite on their poller.
-		if membership != "invite" {
+		edd := *ed
+		if targetUser == userID {
+			notifiedTarget = true
 			if shouldForceInitial {
-				ed.ForceInitial = true
-			}
-			l := d.userToReceiver[targetUser]
-			if l != nil {
-				l.OnNewEvent(ctx, ed)
+				edd.ForceInitial = true
 			}
 		}
+		dispatches = append(dispatches, perUserDispatch{userID, entry, &edd})
+	}
+	var targetEntry *receiverEntry
+	// e.g invites/leaves where you aren't joined yet but need to know about it.
+	// We expect invites to come down the invitee's poller, which triggers OnInvite code paths and
+	// not normal event codepaths. We need the separate code path to ensure invite stripped state
+	// is sent to the conn and not live data. Hence, if we get the invite event early from a different
+	// connection, do not send it to the target, as they must wait for the invite on their poller.
+	if targetUser != "" && !notifiedTarget && membership != "invite" {
+		targetEntry = d.userToQueue[targetUser]
+	}
+	d.userToReceiverMu.RUnlock()
+
+	// global listeners (invoke before per-user listeners so caches can update)
+	if globalEntry != nil {
+		d.enqueueRoomEvent(globalEntry, queuedDispatch{kind: dispatchRoomEvent, ctx: ctx, event: ed})
+	}
+
+	// per-user listeners
+	for _, pd := range dispatches {
+		d.enqueueRoomEvent(pd.entry, queuedDispatch{kind: dispatchRoomEvent, ctx: ctx, event: pd.ed})
+		// Push rule evaluation can call out to a PushRulesLoader/
+		// RoomStateLoader and a Pusher, any of which may be slow; queue it
+		// onto the user's own delivery goroutine via enqueueDropOldest
+		// (the same policy as typing/ephemeral) instead of calling it
+		// inline here, where it would block this v2 poller for every user
+		// in the room.
+		userID, ed := pd.userID, pd.ed
+		d.enqueueDropOldest(pd.entry, queuedDispatch{kind: dispatchCallback, ctx: ctx, fn: func() {
+			d.evaluatePushRules(ctx, userID, ed)
+		}})
+	}
+
+	if targetEntry != nil {
+		if shouldForceInitial {
+			ed.ForceInitial = true
+		}
+		d.enqueueRoomEvent(targetEntry, queuedDispatch{kind: dispatchRoomEvent, ctx: ctx, event: ed})
+	}
+}
+
+// OnPurgeRoom evicts roomID from every piece of Dispatcher-owned state
+// (the joined-rooms tracker and shared-room bookkeeping), then fans the
+// purge out to every registered receiver that implements RoomPurgeReceiver
+// in a single pass. That part of the contract only covers receivers that
+// actually implement RoomPurgeReceiver: this call does not know, and has no
+// way to check, whether the global cache, user caches, or live connections
+// still hold derived state for roomID beyond what they chose to expose
+// through that interface. Callers must not treat a successful return as
+// "every trace of roomID is gone" on that basis alone; it only guarantees
+// the dispatcher's own bookkeeping is gone and every opted-in receiver has
+// been told.
+func (d *Dispatcher) OnPurgeRoom(ctx context.Context, roomID string) {
+	members, _ := d.jrt.JoinedUsersForRoom(roomID, func(userID string) bool {
+		return userID != DispatcherAllUsers
+	})
+
+	// Unwind shared-room bookkeeping as if every member left roomID at once,
+	// so device list tracking doesn't think they still share it.
+	for _, pair := range d.sharedRooms.purgeRoom(roomID, members) {
+		d.notifyDeviceListChange(ctx, pair[1], nil, []string{pair[0]})
+		d.notifyDeviceListChange(ctx, pair[0], nil, []string{pair[1]})
+	}
+
+	// Evict roomID from the joined-rooms tracker so it looks empty to any
+	// future query.
+	d.jrt.ReloadMembershipsForRoom(roomID, nil, nil)
+
+	d.userToReceiverMu.RLock()
+	defer d.userToReceiverMu.RUnlock()
+
+	// global listener first: the global cache owns the canonical room
+	// metadata, so it should have evicted roomID before any user cache goes
+	// looking for it.
+	notified := 0
+	if listener := d.userToReceiver[DispatcherAllUsers]; listener != nil {
+		if pr, ok := listener.(RoomPurgeReceiver); ok {
+			pr.OnPurgeRoom(ctx, roomID)
+			notified++
+		}
+	}
+	for userID, r := range d.userToReceiver {
+		if userID == DispatcherAllUsers {
+			continue
+		}
+		if pr, ok := r.(RoomPurgeReceiver); ok {
+			pr.OnPurgeRoom(ctx, roomID)
+			notified++
+		}
+	}
+	if notified == 0 {
+		// Nothing in this process implements RoomPurgeReceiver yet, so the
+		// above only ever touches dispatcher-owned bookkeeping. Surface
+		// that loudly rather than let an operator assume the purge reached
+		// the caches/connections too.
+		logger.Warn().Str("room", roomID).Msg("Dispatcher.OnPurgeRoom: no registered receiver implements RoomPurgeReceiver, only dispatcher bookkeeping was purged")
 	}
 }
 
@@ -282,6 +849,13 @@ func (d *Dispatcher) OnInvalidateRoom(
 	}
 	gc.OnInvalidateRoom(ctx, roomID)
 
+	// Snapshot who we thought was joined before the reload, so we can spot
+	// implicit leaves below: state resets can make a user disappear from a
+	// room without ever producing a leave event for them.
+	previouslyJoined, _ := d.jrt.JoinedUsersForRoom(roomID, func(userID string) bool {
+		return userID != DispatcherAllUsers
+	})
+
 	// Reset the joined room tracker.
 	d.jrt.ReloadMembershipsForRoom(roomID, internal.Keys(joins), internal.Keys(invites))
 
@@ -315,8 +889,6 @@ func (d *Dispatcher) OnInvalidateRoom(
 	d.userToReceiverMu.RLock()
 	defer d.userToReceiverMu.RUnlock()
 
-	// TODO: if there is a state reset, users can leave without having a leave event.
-	// We would still need to mark those users as having left their rooms.
 	for userID, leaveEvent := range leaves {
 		receiver = d.userToReceiver[userID]
 		if receiver == nil {
@@ -328,6 +900,51 @@ func (d *Dispatcher) OnInvalidateRoom(
 		}
 	}
 
+	// A state reset can make a user vanish from a room's membership without
+	// ever producing a leave event for them: they were joined before the
+	// reload, but are neither joined nor invited afterwards, and didn't get
+	// an explicit leave event above. Treat them as implicit leavers: drop
+	// them from the tracker, synthesise a leave so their UserCache and any
+	// live connections see it, and let device list tracking know they no
+	// longer share this room with anyone.
+	stillAround := make(map[string]bool, len(joins)+len(invites))
+	for userID := range joins {
+		stillAround[userID] = true
+	}
+	for userID := range invites {
+		stillAround[userID] = true
+	}
+	for _, userID := range previouslyJoined {
+		if _, explicitLeave := leaves[userID]; stillAround[userID] || explicitLeave {
+			continue
+		}
+		d.jrt.UserLeftRoom(userID, roomID)
+		d.unshareRoomWithOthers(ctx, userID, roomID, previouslyJoined)
+
+		syntheticLeaveEvent, err := json.Marshal(map[string]interface{}{
+			"type":      "m.room.member",
+			"state_key": userID,
+			"sender":    userID,
+			"content": map[string]interface{}{
+				"membership": "leave",
+				"reason":     "state_reset",
+			},
+		})
+		if err != nil {
+			logger.Err(err).Str("user", userID).Str("room", roomID).Msg("Dispatcher: failed to marshal synthetic leave event")
+			continue
+		}
+
+		receiver = d.userToReceiver[userID]
+		if receiver == nil {
+			continue
+		}
+		uc := receiver.(*caches.UserCache)
+		if uc != nil {
+			uc.OnLeftRoom(ctx, roomID, syntheticLeaveEvent)
+		}
+	}
+
 	for userID, inviteState := range invites {
 		receiver = d.userToReceiver[userID]
 		if receiver == nil {
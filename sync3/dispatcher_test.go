@@ -0,0 +1,116 @@
+package sync3
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+// stubReceiver is a minimal Receiver for exercising Dispatcher.Register/
+// Unregister without needing a real cache or connection.
+type stubReceiver struct {
+	onRegistered func(ctx context.Context) error
+}
+
+func (s *stubReceiver) OnNewEvent(ctx context.Context, event *caches.EventData) {}
+func (s *stubReceiver) OnReceipt(ctx context.Context, receipt internal.Receipt) {}
+func (s *stubReceiver) OnEphemeralEvent(ctx context.Context, roomID string, ephEvent json.RawMessage) {
+}
+func (s *stubReceiver) OnRegistered(ctx context.Context) error {
+	if s.onRegistered != nil {
+		return s.onRegistered(ctx)
+	}
+	return nil
+}
+
+// TestDispatcherRegisterUnregisterConcurrent hammers Register/Unregister for
+// the same userID from many goroutines at once. It doesn't assert which one
+// wins - that's inherently racy - only that userToReceiver and userToQueue
+// never disagree about whether userID is registered, which is the invariant
+// Register's "re-check oldEntry after OnRegistered returns" logic exists to
+// protect.
+func TestDispatcherRegisterUnregisterConcurrent(t *testing.T) {
+	d := NewDispatcher()
+	const userID = "@alice:test"
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.Register(context.Background(), userID, &stubReceiver{})
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.Unregister(userID)
+		}()
+	}
+	wg.Wait()
+
+	d.userToReceiverMu.RLock()
+	_, hasReceiver := d.userToReceiver[userID]
+	_, hasQueue := d.userToQueue[userID]
+	d.userToReceiverMu.RUnlock()
+	if hasReceiver != hasQueue {
+		t.Fatalf("inconsistent state after concurrent Register/Unregister: hasReceiver=%v hasQueue=%v", hasReceiver, hasQueue)
+	}
+}
+
+func TestDispatcherRegisterReplacesPreviousReceiver(t *testing.T) {
+	d := NewDispatcher()
+	const userID = "@alice:test"
+
+	first := &stubReceiver{}
+	if err := d.Register(context.Background(), userID, first); err != nil {
+		t.Fatalf("first Register: %v", err)
+	}
+	if got := d.ReceiverForUser(userID); got != Receiver(first) {
+		t.Fatalf("ReceiverForUser after first Register: got %v, want first", got)
+	}
+
+	second := &stubReceiver{}
+	if err := d.Register(context.Background(), userID, second); err != nil {
+		t.Fatalf("second Register: %v", err)
+	}
+	if got := d.ReceiverForUser(userID); got != Receiver(second) {
+		t.Fatalf("ReceiverForUser after second Register: got %v, want the replacement receiver", got)
+	}
+}
+
+// TestDispatcherRegisterTimesOutOnSlowOnRegistered checks that a receiver
+// whose OnRegistered never returns doesn't wedge Register forever, and is
+// never made reachable for dispatch.
+func TestDispatcherRegisterTimesOutOnSlowOnRegistered(t *testing.T) {
+	d := NewDispatcher()
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	slow := &stubReceiver{onRegistered: func(ctx context.Context) error {
+		<-unblock
+		return nil
+	}}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Register(context.Background(), "@bob:test", slow)
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("Register with a stuck OnRegistered returned nil, want an error once registerTimeout elapses")
+		}
+	case <-time.After(registerTimeout + 2*time.Second):
+		t.Fatalf("Register did not return within registerTimeout")
+	}
+
+	if got := d.ReceiverForUser("@bob:test"); got != nil {
+		t.Fatalf("ReceiverForUser after a timed-out Register: got %v, want nil", got)
+	}
+}
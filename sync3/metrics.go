@@ -0,0 +1,36 @@
+package sync3
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "sliding_sync"
+
+var (
+	receiverQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "dispatcher",
+		Name:      "receiver_queue_depth",
+		Help:      "Number of pending dispatches buffered for a receiver's delivery goroutine.",
+	}, []string{"user_id"})
+
+	receiverQueueDrops = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "dispatcher",
+		Name:      "receiver_queue_drops",
+		Help:      "Dispatches that were dropped (or forced a resync) because a receiver's delivery queue overflowed.",
+	}, []string{"user_id", "reason"})
+)
+
+// deleteReceiverMetrics drops every series for userID from both vectors
+// above. Must be called from Dispatcher.Unregister: without it, a server
+// that sees any significant number of distinct Matrix users over its
+// lifetime accumulates one series per user forever, which is an unbounded
+// cardinality leak in Prometheus. DeletePartialMatch is used for
+// receiverQueueDrops because "reason" isn't known here and may have several
+// values for one user.
+func deleteReceiverMetrics(userID string) {
+	receiverQueueDepth.DeleteLabelValues(userID)
+	receiverQueueDrops.DeletePartialMatch(prometheus.Labels{"user_id": userID})
+}
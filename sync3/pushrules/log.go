@@ -0,0 +1,17 @@
+package pushrules
+
+import (
+	"os"
+
+	"github.com/rs/zerolog"
+)
+
+// logger uses the same console-writer setup as sync3.logger, tagged with
+// its own component name so log lines from this package are identifiable
+// rather than indistinguishable from the dispatcher's. It can't just reuse
+// sync3's logger variable directly: sync3 imports this package, so the
+// reverse import would be a cycle.
+var logger = zerolog.New(os.Stdout).With().Timestamp().Str("component", "pushrules").Logger().Output(zerolog.ConsoleWriter{
+	Out:        os.Stderr,
+	TimeFormat: "15:04:05",
+})
@@ -0,0 +1,312 @@
+// Package pushrules evaluates a user's push rules against incoming events,
+// following the rule kinds and precedence defined by the Matrix spec
+// (override > content > room > sender > underride).
+package pushrules
+
+import (
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// Kind identifies one of the five push rule buckets, in evaluation order.
+type Kind string
+
+const (
+	KindOverride  Kind = "override"
+	KindContent   Kind = "content"
+	KindRoom      Kind = "room"
+	KindSender    Kind = "sender"
+	KindUnderride Kind = "underride"
+)
+
+// Action is the outcome of evaluating a rule that matched an event.
+type Action struct {
+	Notify    bool
+	Sound     string // e.g. "default"; empty means no sound
+	Highlight bool
+}
+
+// DontNotify is returned when no rule matched, or the matching rule was a no-op.
+var DontNotify = Action{}
+
+// Condition is a single predicate that must hold for a rule to match.
+type Condition struct {
+	Kind    string // event_match, contains_display_name, room_member_count, sender_notification_permission
+	Key     string // for event_match: dot-path into the event
+	Pattern string // for event_match: glob pattern; for room_member_count: e.g. "<2", ">=10"
+	Key2    string // for sender_notification_permission: "room" or "notification" key name
+}
+
+// Rule is a single push rule: if all Conditions hold (or Conditions is empty,
+// e.g. for content rules keyed on the rule ID itself), Actions is applied.
+type Rule struct {
+	RuleID     string
+	Kind       Kind
+	Enabled    bool
+	Default    bool
+	Pattern    string // content rules match this against the body; empty uses RuleID as pattern
+	Conditions []Condition
+	Actions    Action
+}
+
+// Ruleset is a user's full compiled set of push rules, bucketed by kind and
+// already in evaluation order within each bucket.
+type Ruleset struct {
+	Override  []Rule
+	Content   []Rule
+	Room      []Rule
+	Sender    []Rule
+	Underride []Rule
+}
+
+// EventContext carries the event fields and per-room information an
+// Evaluator needs beyond the event's content, which is supplied separately
+// to Evaluate as a gjson.Result.
+type EventContext struct {
+	RoomID            string
+	EventType         string
+	Sender            string
+	UserID            string // the user whose rules are being evaluated
+	DisplayName       string // the user's display name in this room, may be empty
+	JoinedMemberCount int
+	// PowerLevelOfSender and NotificationPowerLevels are used to evaluate
+	// sender_notification_permission conditions (e.g. "@room" notifications).
+	PowerLevelOfSender      int
+	NotificationPowerLevels map[string]int
+}
+
+// Evaluator evaluates a Ruleset against an event, in the fixed precedence
+// order: override, content, room, sender, underride. The first rule whose
+// conditions all hold wins.
+type Evaluator struct{}
+
+// Evaluate returns the Action for the first matching rule, and that rule's ID
+// for logging/debugging. If nothing matches, DontNotify is returned. content
+// is the event's "content" key, as that's all that caches.EventData retains.
+func (e Evaluator) Evaluate(content gjson.Result, rs *Ruleset, ectx EventContext) (Action, string) {
+	if rs == nil {
+		return DontNotify, ""
+	}
+	for _, rule := range rs.Override {
+		if !rule.Enabled {
+			continue
+		}
+		if matchConditions(rule.Conditions, content, ectx) {
+			return rule.Actions, rule.RuleID
+		}
+	}
+	if a, id, ok := e.evaluateContent(content, rs.Content); ok {
+		return a, id
+	}
+	for _, rule := range rs.Room {
+		if !rule.Enabled {
+			continue
+		}
+		if rule.RuleID == ectx.RoomID {
+			return rule.Actions, rule.RuleID
+		}
+	}
+	for _, rule := range rs.Sender {
+		if !rule.Enabled {
+			continue
+		}
+		if rule.RuleID == ectx.Sender {
+			return rule.Actions, rule.RuleID
+		}
+	}
+	for _, rule := range rs.Underride {
+		if !rule.Enabled {
+			continue
+		}
+		if matchConditions(rule.Conditions, content, ectx) {
+			return rule.Actions, rule.RuleID
+		}
+	}
+	return DontNotify, ""
+}
+
+func (e Evaluator) evaluateContent(content gjson.Result, rules []Rule) (Action, string, bool) {
+	body := content.Get("body").Str
+	if body == "" {
+		return Action{}, "", false
+	}
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+		pattern := rule.Pattern
+		if pattern == "" {
+			pattern = rule.RuleID
+		}
+		if globMatchWord(pattern, body) {
+			return rule.Actions, rule.RuleID, true
+		}
+	}
+	return Action{}, "", false
+}
+
+func matchConditions(conditions []Condition, content gjson.Result, ectx EventContext) bool {
+	for _, c := range conditions {
+		if !matchCondition(c, content, ectx) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchCondition matches an event_match Key against the event. The "type",
+// "sender" and "room_id" top-level keys come from ectx, since content is all
+// we retain of the event body; everything else is looked up in content
+// directly with any "content." prefix stripped.
+func matchCondition(c Condition, content gjson.Result, ectx EventContext) bool {
+	switch c.Kind {
+	case "event_match":
+		return globMatch(c.Pattern, valueForKey(c.Key, content, ectx))
+	case "contains_display_name":
+		if ectx.DisplayName == "" {
+			return false
+		}
+		return globMatchWord(ectx.DisplayName, content.Get("body").Str)
+	case "room_member_count":
+		return matchMemberCount(c.Pattern, ectx.JoinedMemberCount)
+	case "sender_notification_permission":
+		required, ok := ectx.NotificationPowerLevels[c.Key2]
+		if !ok {
+			required = 50 // Matrix spec default for notification power levels
+		}
+		return ectx.PowerLevelOfSender >= required
+	default:
+		// Unknown condition kinds fail closed: the Matrix spec says a rule
+		// with a condition we don't understand must not match.
+		return false
+	}
+}
+
+func valueForKey(key string, content gjson.Result, ectx EventContext) string {
+	switch key {
+	case "type":
+		return ectx.EventType
+	case "sender":
+		return ectx.Sender
+	case "room_id":
+		return ectx.RoomID
+	}
+	key = strings.TrimPrefix(key, "content.")
+	return content.Get(key).String()
+}
+
+// matchMemberCount parses patterns like "2", "<2", ">=10", "==5".
+func matchMemberCount(pattern string, count int) bool {
+	op := "=="
+	numStr := pattern
+	for _, prefix := range []string{"<=", ">=", "==", "<", ">"} {
+		if strings.HasPrefix(pattern, prefix) {
+			op = prefix
+			numStr = strings.TrimPrefix(pattern, prefix)
+			break
+		}
+	}
+	n := 0
+	for _, r := range numStr {
+		if r < '0' || r > '9' {
+			return false
+		}
+		n = n*10 + int(r-'0')
+	}
+	switch op {
+	case "<":
+		return count < n
+	case ">":
+		return count > n
+	case "<=":
+		return count <= n
+	case ">=":
+		return count >= n
+	default:
+		return count == n
+	}
+}
+
+// globMatch implements the restricted glob syntax used by event_match:
+// '*' matches any run of characters, '?' matches a single character, and the
+// match is case-insensitive and must cover the whole string.
+func globMatch(pattern, value string) bool {
+	return globMatchCase(pattern, value, true)
+}
+
+// globMatchWord is like globMatch but additionally matches pattern as a
+// whole word anywhere within value (used for content/display-name rules).
+func globMatchWord(pattern, value string) bool {
+	if pattern == "" {
+		return false
+	}
+	if !strings.ContainsAny(pattern, "*?") {
+		return containsWord(strings.ToLower(value), strings.ToLower(pattern))
+	}
+	return globMatchCase(pattern, value, false)
+}
+
+func containsWord(haystack, word string) bool {
+	idx := strings.Index(haystack, word)
+	for idx != -1 {
+		before := idx == 0 || !isWordChar(rune(haystack[idx-1]))
+		after := idx+len(word) >= len(haystack) || !isWordChar(rune(haystack[idx+len(word)]))
+		if before && after {
+			return true
+		}
+		next := strings.Index(haystack[idx+1:], word)
+		if next == -1 {
+			return false
+		}
+		idx = idx + 1 + next
+	}
+	return false
+}
+
+func isWordChar(r rune) bool {
+	return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
+
+func globMatchCase(pattern, value string, anchored bool) bool {
+	pattern = strings.ToLower(pattern)
+	value = strings.ToLower(value)
+	p, v := []rune(pattern), []rune(value)
+	if anchored {
+		return globMatchRunes(p, v)
+	}
+	// unanchored: the pattern must cover a run of value that starts and ends
+	// on word boundaries.
+	for i := 0; i <= len(v); i++ {
+		if i > 0 && isWordChar(v[i-1]) {
+			continue
+		}
+		for j := i; j <= len(v); j++ {
+			if (j == len(v) || !isWordChar(v[j])) && globMatchRunes(p, v[i:j]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func globMatchRunes(pattern, value []rune) bool {
+	if len(pattern) == 0 {
+		return len(value) == 0
+	}
+	if pattern[0] == '*' {
+		for i := 0; i <= len(value); i++ {
+			if globMatchRunes(pattern[1:], value[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(value) == 0 {
+		return false
+	}
+	if pattern[0] == '?' || pattern[0] == value[0] {
+		return globMatchRunes(pattern[1:], value[1:])
+	}
+	return false
+}
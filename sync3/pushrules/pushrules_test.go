@@ -0,0 +1,152 @@
+package pushrules
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestMatchMemberCount(t *testing.T) {
+	tests := []struct {
+		pattern string
+		count   int
+		want    bool
+	}{
+		{"2", 2, true},
+		{"2", 3, false},
+		{"<2", 1, true},
+		{"<2", 2, false},
+		{">=10", 10, true},
+		{">=10", 9, false},
+		{"<=5", 5, true},
+		{"<=5", 6, false},
+		{">3", 4, true},
+		{">3", 3, false},
+		{"==5", 5, true},
+		{"not-a-number", 5, false},
+	}
+	for _, tc := range tests {
+		if got := matchMemberCount(tc.pattern, tc.count); got != tc.want {
+			t.Errorf("matchMemberCount(%q, %d) = %v, want %v", tc.pattern, tc.count, got, tc.want)
+		}
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, value string
+		want           bool
+	}{
+		{"m.room.message", "m.room.message", true},
+		{"m.room.message", "m.room.member", false},
+		{"m.room.*", "m.room.message", true},
+		{"m.room.*", "m.space.child", false},
+		{"m.call.??????", "m.call.invite", true},
+		{"*", "anything", true},
+		{"Hello", "hello", true}, // case-insensitive
+	}
+	for _, tc := range tests {
+		if got := globMatch(tc.pattern, tc.value); got != tc.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tc.pattern, tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestGlobMatchWord(t *testing.T) {
+	tests := []struct {
+		pattern, value string
+		want           bool
+	}{
+		{"alice", "hey alice, are you there?", true},
+		{"alice", "malice aforethought", false}, // must match a whole word, not a substring
+		{"ali*", "alice says hi", true},
+		{"", "anything", false},
+	}
+	for _, tc := range tests {
+		if got := globMatchWord(tc.pattern, tc.value); got != tc.want {
+			t.Errorf("globMatchWord(%q, %q) = %v, want %v", tc.pattern, tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestMatchConditionSenderNotificationPermission(t *testing.T) {
+	ectx := EventContext{PowerLevelOfSender: 50, NotificationPowerLevels: map[string]int{"room": 50}}
+	c := Condition{Kind: "sender_notification_permission", Key2: "room"}
+	if !matchCondition(c, gjson.Result{}, ectx) {
+		t.Fatalf("sender at the required power level should match")
+	}
+
+	ectx.PowerLevelOfSender = 49
+	if matchCondition(c, gjson.Result{}, ectx) {
+		t.Fatalf("sender below the required power level should not match")
+	}
+
+	// no explicit "room" power level configured: the Matrix spec default of 50 applies.
+	ectx = EventContext{PowerLevelOfSender: 50, NotificationPowerLevels: map[string]int{}}
+	if !matchCondition(c, gjson.Result{}, ectx) {
+		t.Fatalf("sender at the default required power level (50) should match")
+	}
+}
+
+func TestMatchConditionContainsDisplayName(t *testing.T) {
+	ectx := EventContext{DisplayName: "Alice"}
+	c := Condition{Kind: "contains_display_name"}
+
+	content := gjson.Parse(`{"body":"hey Alice, check this out"}`)
+	if !matchCondition(c, content, ectx) {
+		t.Fatalf("body mentioning the display name should match")
+	}
+
+	content = gjson.Parse(`{"body":"nothing relevant here"}`)
+	if matchCondition(c, content, ectx) {
+		t.Fatalf("body not mentioning the display name should not match")
+	}
+
+	if matchCondition(c, content, EventContext{}) {
+		t.Fatalf("a user with no display name set should never match")
+	}
+}
+
+func TestEvaluatorPrecedenceOverrideBeatsUnderride(t *testing.T) {
+	rs := &Ruleset{
+		Override: []Rule{{
+			RuleID:     "override-rule",
+			Enabled:    true,
+			Conditions: []Condition{{Kind: "event_match", Key: "type", Pattern: "m.room.message"}},
+			Actions:    Action{Notify: true, Highlight: true},
+		}},
+		Underride: []Rule{{
+			RuleID:  ".m.rule.message",
+			Enabled: true,
+			Actions: Action{Notify: true},
+		}},
+	}
+	ectx := EventContext{EventType: "m.room.message"}
+	content := gjson.Parse(`{"body":"hello"}`)
+
+	var e Evaluator
+	action, ruleID := e.Evaluate(content, rs, ectx)
+	if ruleID != "override-rule" {
+		t.Fatalf("Evaluate: matched rule %q, want override-rule to win over the underride rule", ruleID)
+	}
+	if !action.Notify || !action.Highlight {
+		t.Fatalf("Evaluate: got action %+v, want Notify and Highlight", action)
+	}
+}
+
+func TestEvaluatorDisabledRuleNeverMatches(t *testing.T) {
+	rs := &Ruleset{
+		Override: []Rule{{
+			RuleID:     "disabled-rule",
+			Enabled:    false,
+			Conditions: []Condition{{Kind: "event_match", Key: "type", Pattern: "m.room.message"}},
+			Actions:    Action{Notify: true},
+		}},
+	}
+	ectx := EventContext{EventType: "m.room.message"}
+	var e Evaluator
+	action, ruleID := e.Evaluate(gjson.Result{}, rs, ectx)
+	if ruleID != "" || action.Notify {
+		t.Fatalf("Evaluate: matched disabled rule %q with action %+v, want DontNotify", ruleID, action)
+	}
+}
@@ -0,0 +1,177 @@
+package pushrules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxQueuedNotifies bounds how many outstanding notifications we will buffer
+// for a single gateway before we start dropping the oldest ones. A gateway
+// that is down for a long time should not be able to grow this queue without
+// bound.
+const maxQueuedNotifies = 256
+
+// maxRetries is the number of delivery attempts made for a single
+// notification before it is given up on.
+const maxRetries = 5
+
+// Pushkey identifies a single device's push gateway registration.
+type Pushkey struct {
+	Gateway string // base URL of the Sygnal-compatible push gateway, e.g. https://sygnal.example.org
+	Key     string // the pushkey itself, opaque to us
+	AppID   string
+	Format  string // event_id_only or empty
+}
+
+// Notification is the payload sent to a Sygnal gateway's /notify endpoint for
+// a single device.
+type Notification struct {
+	EventID           string          `json:"event_id,omitempty"`
+	RoomID            string          `json:"room_id,omitempty"`
+	Type              string          `json:"type,omitempty"`
+	Sender            string          `json:"sender,omitempty"`
+	SenderDisplayName string          `json:"sender_display_name,omitempty"`
+	RoomName          string          `json:"room_name,omitempty"`
+	Content           json.RawMessage `json:"content,omitempty"`
+	Counts            NotifyCounts    `json:"counts"`
+	Devices           []Device        `json:"devices"`
+}
+
+type NotifyCounts struct {
+	Unread      int `json:"unread"`
+	MissedCalls int `json:"missed_calls,omitempty"`
+}
+
+type Device struct {
+	AppID     string          `json:"app_id"`
+	Pushkey   string          `json:"pushkey"`
+	PushkeyTS int64           `json:"pushkey_ts,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Tweaks    DeviceTweaks    `json:"tweaks,omitempty"`
+}
+
+type DeviceTweaks struct {
+	Sound     string `json:"sound,omitempty"`
+	Highlight bool   `json:"highlight,omitempty"`
+}
+
+// SygnalClient dispatches notifications to Sygnal-compatible push gateways.
+// Each gateway URL gets its own goroutine and queue, so a single misbehaving
+// or slow gateway cannot block delivery to any other gateway. Notifications
+// for different pushkeys (and users) on the same gateway share that one
+// queue and are delivered one at a time, in order.
+type SygnalClient struct {
+	httpClient *http.Client
+
+	mu     sync.Mutex
+	queues map[string]chan queuedNotify // keyed by gateway URL
+}
+
+type queuedNotify struct {
+	ctx context.Context
+	pk  Pushkey
+	n   Notification
+}
+
+func NewSygnalClient(httpClient *http.Client) *SygnalClient {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &SygnalClient{
+		httpClient: httpClient,
+		queues:     make(map[string]chan queuedNotify),
+	}
+}
+
+// Notify enqueues a notification for delivery to pk.Gateway. It never blocks
+// on network I/O: if the gateway's queue is full, the oldest pending
+// notification is dropped to make room, on the assumption that a fresher
+// notification (typically a higher unread count) supersedes it. The
+// triggering ctx is deliberately not threaded through to the worker:
+// delivery (and its retries, which can run for several seconds) is meant to
+// outlive the request/poll that called Notify, and using ctx here would let
+// that call's deadline or cancellation silently drop a legitimate retry.
+func (s *SygnalClient) Notify(ctx context.Context, pk Pushkey, n Notification) {
+	q := s.queueFor(pk.Gateway)
+	qn := queuedNotify{ctx: context.Background(), pk: pk, n: n}
+	select {
+	case q <- qn:
+	default:
+		select {
+		case <-q:
+		default:
+		}
+		select {
+		case q <- qn:
+		default:
+			// the worker raced us and drained the queue; drop silently
+		}
+	}
+}
+
+func (s *SygnalClient) queueFor(gateway string) chan queuedNotify {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.queues[gateway]
+	if !ok {
+		q = make(chan queuedNotify, maxQueuedNotifies)
+		s.queues[gateway] = q
+		go s.worker(gateway, q)
+	}
+	return q
+}
+
+func (s *SygnalClient) worker(gateway string, q chan queuedNotify) {
+	for qn := range q {
+		s.deliver(qn)
+	}
+}
+
+func (s *SygnalClient) deliver(qn queuedNotify) {
+	body, err := json.Marshal(struct {
+		Notification Notification `json:"notification"`
+	}{qn.n})
+	if err != nil {
+		logger.Err(err).Str("gateway", qn.pk.Gateway).Msg("pushrules: failed to marshal notification")
+		return
+	}
+
+	url := qn.pk.Gateway + "/_matrix/push/v1/notify"
+	backoff := 500 * time.Millisecond
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-qn.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		req, err := http.NewRequestWithContext(qn.ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := s.httpClient.Do(req)
+		if err != nil {
+			logger.Warn().Err(err).Str("gateway", qn.pk.Gateway).Int("attempt", attempt).Msg("pushrules: notify request failed")
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return
+		}
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			// the gateway rejected the pushkey outright (e.g. 404/410); retrying won't help.
+			logger.Warn().Str("gateway", qn.pk.Gateway).Int("status", resp.StatusCode).Msg("pushrules: gateway rejected pushkey, giving up")
+			return
+		}
+		logger.Warn().Str("gateway", qn.pk.Gateway).Int("status", resp.StatusCode).Int("attempt", attempt).Msg("pushrules: notify got 5xx, retrying")
+	}
+	logger.Err(fmt.Errorf("exhausted retries")).Str("gateway", qn.pk.Gateway).Msg("pushrules: giving up on notification")
+}
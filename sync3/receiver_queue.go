@@ -0,0 +1,158 @@
+package sync3
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+// defaultReceiverQueueDepth is how many pending dispatches we buffer for a
+// single receiver before the configured overflow policy kicks in, unless
+// overridden via Dispatcher.SetReceiverQueueDepth.
+const defaultReceiverQueueDepth = 2048
+
+// roomEventSendTimeout bounds how long we'll block trying to deliver a room
+// event to a receiver using the block-with-timeout policy, so a single dead
+// receiver can delay but never wedge the dispatcher.
+const roomEventSendTimeout = 2 * time.Second
+
+type dispatchKind int
+
+const (
+	dispatchRoomEvent dispatchKind = iota
+	dispatchEphemeralEvent
+	dispatchReceipt
+	dispatchCallback
+)
+
+// queuedDispatch is a single unit of work destined for one receiver's
+// delivery goroutine. Only the fields relevant to kind are populated.
+type queuedDispatch struct {
+	kind dispatchKind
+	ctx  context.Context
+
+	event    *caches.EventData
+	roomID   string
+	ephEvent json.RawMessage
+	receipt  internal.Receipt
+	// fn is used by dispatchCallback, for dispatches (device list changes,
+	// typing updates) whose receiver-interface assertion is cheaper to do
+	// once at enqueue time than to re-encode as a queuedDispatch field.
+	fn func()
+}
+
+// receiverEntry is the per-receiver delivery goroutine and its bounded
+// queue, created in Dispatcher.Register and torn down in Unregister.
+type receiverEntry struct {
+	userID   string
+	receiver Receiver
+	ch       chan queuedDispatch
+	stop     chan struct{}
+
+	// needsResync is set by the force-resync-on-overflow policy when a room
+	// event is dropped for this receiver; the next room event we do manage
+	// to deliver is marked ForceInitial so the connection resyncs instead of
+	// silently missing state.
+	needsResync int32
+}
+
+func newReceiverEntry(userID string, r Receiver, queueDepth int) *receiverEntry {
+	return &receiverEntry{
+		userID:   userID,
+		receiver: r,
+		ch:       make(chan queuedDispatch, queueDepth),
+		stop:     make(chan struct{}),
+	}
+}
+
+// run drains e.ch until Dispatcher.Unregister closes e.stop. Every dispatch
+// that can be deferred (room events, ephemeral events, receipts, device list
+// and typing changes) goes through here, so a slow or wedged receiver only
+// ever blocks its own queue, never the rest of the dispatcher. Two dispatcher
+// entry points bypass it: OnPurgeRoom calls receivers directly so a purge can
+// be acknowledged as fully applied before the HTTP handler returns, and
+// OnInvalidateRoom calls the global cache and user caches directly.
+func (d *Dispatcher) run(e *receiverEntry) {
+	for {
+		select {
+		case qd := <-e.ch:
+			d.deliver(e, qd)
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(e *receiverEntry, qd queuedDispatch) {
+	receiverQueueDepth.WithLabelValues(e.userID).Set(float64(len(e.ch)))
+	switch qd.kind {
+	case dispatchRoomEvent:
+		ed := qd.event
+		if atomic.CompareAndSwapInt32(&e.needsResync, 1, 0) {
+			resynced := *ed
+			resynced.ForceInitial = true
+			ed = &resynced
+		}
+		e.receiver.OnNewEvent(qd.ctx, ed)
+	case dispatchEphemeralEvent:
+		e.receiver.OnEphemeralEvent(qd.ctx, qd.roomID, qd.ephEvent)
+	case dispatchReceipt:
+		e.receiver.OnReceipt(qd.ctx, qd.receipt)
+	case dispatchCallback:
+		qd.fn()
+	}
+}
+
+// enqueueRoomEvent applies the room-event overflow policy: block-with-timeout
+// for the global listener (there's only one, and it must not miss events),
+// force-resync-on-overflow for per-user receivers (blocking one slow user
+// cache must never delay anyone else).
+func (d *Dispatcher) enqueueRoomEvent(e *receiverEntry, qd queuedDispatch) {
+	if e.userID == DispatcherAllUsers {
+		d.enqueueBlockWithTimeout(e, qd)
+		return
+	}
+	select {
+	case e.ch <- qd:
+	default:
+		atomic.StoreInt32(&e.needsResync, 1)
+		receiverQueueDrops.WithLabelValues(e.userID, "force_resync").Inc()
+	}
+}
+
+func (d *Dispatcher) enqueueBlockWithTimeout(e *receiverEntry, qd queuedDispatch) {
+	timer := time.NewTimer(roomEventSendTimeout)
+	defer timer.Stop()
+	select {
+	case e.ch <- qd:
+	case <-timer.C:
+		logger.Warn().Str("user", e.userID).Msg("Dispatcher: receiver queue full, dropping room event after timeout")
+		receiverQueueDrops.WithLabelValues(e.userID, "block_timeout").Inc()
+	}
+}
+
+// enqueueDropOldest applies the drop-oldest overflow policy used for
+// ephemeral events and receipts: these are superseded by later updates, so
+// losing a stale one is harmless, whereas blocking the v2 poller is not.
+func (d *Dispatcher) enqueueDropOldest(e *receiverEntry, qd queuedDispatch) {
+	select {
+	case e.ch <- qd:
+		return
+	default:
+	}
+	select {
+	case <-e.ch:
+		receiverQueueDrops.WithLabelValues(e.userID, "drop_oldest").Inc()
+	default:
+	}
+	select {
+	case e.ch <- qd:
+	default:
+		// the queue was refilled by another goroutine between our drain and
+		// our retry; give up rather than spin.
+	}
+}
@@ -0,0 +1,65 @@
+package sync3
+
+import (
+	"context"
+
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/matrix-org/sliding-sync/sync3/pushrules"
+)
+
+// SygnalPusher is the Pusher implementation for a single device's Sygnal-
+// compatible push gateway registration. It is the glue between push rule
+// evaluation in the Dispatcher and the actual HTTP delivery in
+// pushrules.SygnalClient: OnPushableEvent builds a pushrules.Notification
+// from whatever evaluatePushRules already worked out and hands it to the
+// client, which owns queuing, retries and backoff from there.
+//
+// Callers that own pusher registration (e.g. the /pushers/set handler)
+// construct one SygnalPusher per registered device and pass it to
+// Dispatcher.RegisterPusher; this package does not call RegisterPusher
+// itself, since it has no way to discover a user's pushers on its own.
+type SygnalPusher struct {
+	Client  *pushrules.SygnalClient
+	Pushkey pushrules.Pushkey
+	AppID   string
+}
+
+// NewSygnalPusher constructs a SygnalPusher for a single device's pushkey,
+// delivering through client.
+func NewSygnalPusher(client *pushrules.SygnalClient, pushkey pushrules.Pushkey, appID string) *SygnalPusher {
+	return &SygnalPusher{
+		Client:  client,
+		Pushkey: pushkey,
+		AppID:   appID,
+	}
+}
+
+// OnPushableEvent implements Pusher by formatting event and roomCtx as a
+// Sygnal Notification and enqueueing it for delivery. It never blocks on
+// network I/O: SygnalClient.Notify only enqueues, the actual HTTP call
+// happens on the client's own per-gateway worker.
+func (p *SygnalPusher) OnPushableEvent(ctx context.Context, userID string, action pushrules.Action, event *caches.EventData, roomCtx PushRoomContext) {
+	n := pushrules.Notification{
+		RoomID:            event.RoomID,
+		Type:              event.EventType,
+		Sender:            event.Sender,
+		SenderDisplayName: roomCtx.DisplayNameOfSender,
+		RoomName:          roomCtx.RoomName,
+		Content:           []byte(event.Content.Raw),
+		Counts: pushrules.NotifyCounts{
+			// We don't track a running unread count here, so report this
+			// event alone rather than claim a count of 0, which gateways
+			// treat as "nothing to show".
+			Unread: 1,
+		},
+		Devices: []pushrules.Device{{
+			AppID:   p.AppID,
+			Pushkey: p.Pushkey.Key,
+			Tweaks: pushrules.DeviceTweaks{
+				Sound:     action.Sound,
+				Highlight: action.Highlight,
+			},
+		}},
+	}
+	p.Client.Notify(ctx, p.Pushkey, n)
+}
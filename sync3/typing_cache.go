@@ -0,0 +1,134 @@
+package sync3
+
+import (
+	"sync"
+	"time"
+)
+
+// typingTimeout is how long a user is kept in a room's typing set without a
+// fresh m.typing event mentioning them, in case the homeserver never sends
+// the follow-up "stopped typing" EDU (e.g. the user's client crashed).
+const typingTimeout = 30 * time.Second
+
+// typingEntry is a single user's expiry timer within a room's typing set,
+// tagged with a generation. Update bumps the generation every time it
+// refreshes an existing user's timer; expire only acts if the generation it
+// was scheduled with still matches, so a timer that had already fired and
+// was blocked on TypingCache.mu when Update ran can't wrongly evict the
+// fresh entry Update just installed.
+type typingEntry struct {
+	timer *time.Timer
+	gen   uint64
+}
+
+// TypingCache tracks, per room, the set of userIDs the homeserver most
+// recently told us are typing. Keeping this in the Dispatcher (rather than
+// just diffing and forwarding every m.typing event) means a connection that
+// joins mid-typing can read the current set straight off the cache for its
+// initial sync payload, instead of waiting for the next delta.
+type TypingCache struct {
+	mu          sync.Mutex
+	roomToUsers map[string]map[string]*typingEntry
+	onExpire    func(roomID, userID string)
+}
+
+// NewTypingCache creates a TypingCache. onExpire is invoked (off the calling
+// goroutine) when a user's typingTimeout elapses without a refresh; callers
+// typically use this to re-run the same change notification logic as a
+// normal update.
+func NewTypingCache(onExpire func(roomID, userID string)) *TypingCache {
+	return &TypingCache{
+		roomToUsers: make(map[string]map[string]*typingEntry),
+		onExpire:    onExpire,
+	}
+}
+
+// Update replaces roomID's typing set with userIDs, (re)starting the expiry
+// timer for everyone in it. It reports whether the visible set actually
+// changed, and the current set after the update, so the caller can suppress
+// redundant notifications (e.g. a retransmit of the same m.typing event).
+func (t *TypingCache) Update(roomID string, userIDs []string) (changed bool, current []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	existing := t.roomToUsers[roomID]
+	next := make(map[string]bool, len(userIDs))
+	for _, u := range userIDs {
+		next[u] = true
+	}
+
+	changed = !sameUserSet(existing, next)
+
+	users := make(map[string]*typingEntry, len(userIDs))
+	for _, u := range userIDs {
+		gen := uint64(1)
+		if prev, ok := existing[u]; ok {
+			prev.timer.Stop()
+			gen = prev.gen + 1
+		}
+		entry := &typingEntry{gen: gen}
+		entry.timer = time.AfterFunc(typingTimeout, func(userID string, gen uint64) func() {
+			return func() { t.expire(roomID, userID, gen) }
+		}(u, gen))
+		users[u] = entry
+	}
+	// stop timers for anyone who is no longer in the set
+	for u, entry := range existing {
+		if !next[u] {
+			entry.timer.Stop()
+		}
+	}
+	if len(users) == 0 {
+		delete(t.roomToUsers, roomID)
+	} else {
+		t.roomToUsers[roomID] = users
+	}
+
+	return changed, userIDs
+}
+
+// CurrentlyTyping returns roomID's current typing set, for seeding a
+// late-joining connection's initial sync payload.
+func (t *TypingCache) CurrentlyTyping(roomID string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	users := t.roomToUsers[roomID]
+	result := make([]string, 0, len(users))
+	for u := range users {
+		result = append(result, u)
+	}
+	return result
+}
+
+func (t *TypingCache) expire(roomID, userID string, gen uint64) {
+	t.mu.Lock()
+	users := t.roomToUsers[roomID]
+	entry := users[userID]
+	if entry == nil || entry.gen != gen {
+		// userID was removed, or Update already refreshed them with a newer
+		// timer, since this timer fired; this expiry is stale, ignore it.
+		t.mu.Unlock()
+		return
+	}
+	delete(users, userID)
+	if len(users) == 0 {
+		delete(t.roomToUsers, roomID)
+	}
+	t.mu.Unlock()
+
+	if t.onExpire != nil {
+		t.onExpire(roomID, userID)
+	}
+}
+
+func sameUserSet(entries map[string]*typingEntry, users map[string]bool) bool {
+	if len(entries) != len(users) {
+		return false
+	}
+	for u := range users {
+		if _, ok := entries[u]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package sync3
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestTypingCacheUpdateChanged(t *testing.T) {
+	tc := NewTypingCache(func(roomID, userID string) {})
+
+	changed, current := tc.Update("room1", []string{"alice"})
+	if !changed || !sameStringSet(current, []string{"alice"}) {
+		t.Fatalf("first Update: got changed=%v current=%v, want changed=true current=[alice]", changed, current)
+	}
+
+	// an identical retransmit of the same typing set must not be reported
+	// as a change.
+	if changed, _ = tc.Update("room1", []string{"alice"}); changed {
+		t.Fatalf("retransmit of the same set: got changed=true, want false")
+	}
+
+	if changed, _ = tc.Update("room1", []string{"alice", "bob"}); !changed {
+		t.Fatalf("adding bob: got changed=false, want true")
+	}
+
+	changed, current = tc.Update("room1", nil)
+	if !changed || len(current) != 0 {
+		t.Fatalf("clearing the room: got changed=%v current=%v, want changed=true current=[]", changed, current)
+	}
+	if got := tc.CurrentlyTyping("room1"); len(got) != 0 {
+		t.Fatalf("CurrentlyTyping after clear: got %v, want none", got)
+	}
+}
+
+// TestTypingCacheStaleExpiryIgnored simulates the exact race the generation
+// counter on typingEntry exists to prevent: a timer that already fired and
+// is blocked acquiring TypingCache.mu while Update installs a fresh timer
+// for the same user must not evict the entry Update just installed once it
+// gets the lock.
+func TestTypingCacheStaleExpiryIgnored(t *testing.T) {
+	var mu sync.Mutex
+	var expired []string
+	tc := NewTypingCache(func(roomID, userID string) {
+		mu.Lock()
+		expired = append(expired, userID)
+		mu.Unlock()
+	})
+
+	tc.Update("room1", []string{"alice"})
+
+	tc.mu.Lock()
+	staleGen := tc.roomToUsers["room1"]["alice"].gen
+	tc.mu.Unlock()
+
+	// alice's entry gets refreshed, bumping her generation...
+	tc.Update("room1", []string{"alice"})
+
+	// ...but the timer scheduled under the old generation fires anyway, as
+	// if it had already fired before Update reached prev.timer.Stop().
+	tc.expire("room1", "alice", staleGen)
+
+	if got := tc.CurrentlyTyping("room1"); !sameStringSet(got, []string{"alice"}) {
+		t.Fatalf("stale expiry evicted a refreshed entry: CurrentlyTyping=%v, want [alice]", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(expired) != 0 {
+		t.Fatalf("stale expiry invoked onExpire: %v, want none", expired)
+	}
+}
+
+// TestTypingCacheCurrentExpiryFires is the mirror of the above: an expiry
+// under the entry's current generation must actually evict it and fire
+// onExpire.
+func TestTypingCacheCurrentExpiryFires(t *testing.T) {
+	var mu sync.Mutex
+	var expired []string
+	tc := NewTypingCache(func(roomID, userID string) {
+		mu.Lock()
+		expired = append(expired, userID)
+		mu.Unlock()
+	})
+
+	tc.Update("room1", []string{"alice"})
+	tc.mu.Lock()
+	gen := tc.roomToUsers["room1"]["alice"].gen
+	tc.mu.Unlock()
+
+	tc.expire("room1", "alice", gen)
+
+	if got := tc.CurrentlyTyping("room1"); len(got) != 0 {
+		t.Fatalf("CurrentlyTyping after a current-generation expiry: got %v, want none", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !sameStringSet(expired, []string{"alice"}) {
+		t.Fatalf("onExpire callbacks: got %v, want [alice]", expired)
+	}
+}